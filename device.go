@@ -0,0 +1,243 @@
+// Capture device state: buffer lifecycle and runtime format changes
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/thinkski/frameserver/v4l2"
+)
+
+// pollTimeout bounds each wait for a frame in pump, so a cancelled
+// context is noticed promptly instead of blocking indefinitely in
+// select()/poll().
+const pollTimeout = 2 * time.Second
+
+// device owns the open V4L2 file descriptor, the mmap'd capture buffers,
+// the encoder that turns each raw buffer into a JPEG, and the ring of
+// completed frames. mu serializes format changes (via reconfigure)
+// against the background pump so a change of resolution or pixel format
+// never runs concurrently with a DQBUF/QBUF cycle.
+type device struct {
+	mu sync.RWMutex
+
+	fd      int
+	buffers [][]byte // raw mmap'd capture buffers, one per slot
+	jpegBuf []*bytes.Buffer
+	encoder Encoder
+	frames  *ring
+
+	width       uint32
+	height      uint32
+	pixelformat uint32
+
+	driver string
+	card   string
+}
+
+// openDevice opens path, queries its capabilities, and negotiates the
+// initial format, buffer count, and mmaps, leaving the stream stopped.
+func openDevice(path string, width, height, pixelformat uint32, numBuffers int) (*device, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &device{fd: fd, frames: newRing(numBuffers)}
+
+	cap, err := v4l2.QueryCap(fd)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	d.driver = uint8_to_string(cap.Driver[:])
+	d.card = uint8_to_string(cap.Card[:])
+
+	if err := d.setFormat(width, height, pixelformat, numBuffers); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return d, nil
+}
+
+// setFormat applies pixelformat/width/height, then requests and mmaps
+// numBuffers capture buffers and queues all of them. The stream must be
+// stopped before calling this; the caller starts streaming afterwards.
+// Callers must hold d.mu for writing.
+func (d *device) setFormat(width, height, pixelformat uint32, numBuffers int) error {
+	pfmt := v4l2.PixFormat{
+		Type:        v4l2.BufTypeVideoCapture,
+		Width:       width,
+		Height:      height,
+		PixelFormat: pixelformat,
+		Field:       v4l2.FieldNone,
+	}
+	if err := v4l2.SetFormat(d.fd, &pfmt); err != nil {
+		return err
+	}
+
+	count, err := v4l2.RequestBuffers(d.fd, uint32(numBuffers))
+	if err != nil {
+		return err
+	}
+
+	buffers := make([][]byte, count)
+	for i := uint32(0); i < count; i++ {
+		buf, err := v4l2.QueryBuf(d.fd, i)
+		if err != nil {
+			return err
+		}
+
+		data, err := unix.Mmap(
+			d.fd,
+			int64(buf.Offset),
+			int(buf.Length),
+			unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_SHARED,
+		)
+		if err != nil {
+			return err
+		}
+		buffers[i] = data
+
+		if err := v4l2.QBuf(d.fd, &buf); err != nil {
+			return err
+		}
+	}
+
+	encoder, err := newEncoder(int(width), int(height), pixelformat)
+	if err != nil {
+		return err
+	}
+
+	jpegBuf := make([]*bytes.Buffer, len(buffers))
+	for i := range jpegBuf {
+		jpegBuf[i] = new(bytes.Buffer)
+	}
+
+	d.buffers = buffers
+	d.jpegBuf = jpegBuf
+	d.encoder = encoder
+	d.width = width
+	d.height = height
+	d.pixelformat = pixelformat
+	d.frames = newRing(len(buffers))
+
+	return nil
+}
+
+// start begins streaming. Callers must hold d.mu for writing.
+func (d *device) start() error {
+	return v4l2.StreamOn(d.fd)
+}
+
+// stop halts streaming and unmaps all buffers. Callers must hold d.mu
+// for writing.
+func (d *device) stop() error {
+	if err := v4l2.StreamOff(d.fd); err != nil {
+		return err
+	}
+	for _, b := range d.buffers {
+		unix.Munmap(b)
+	}
+	d.buffers = nil
+	return nil
+}
+
+// close stops the stream (if running) and closes the device. It is
+// safe to call even if the stream was never started.
+func (d *device) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var stopErr error
+	if d.buffers != nil {
+		stopErr = d.stop()
+	}
+	if err := unix.Close(d.fd); err != nil && stopErr == nil {
+		stopErr = err
+	}
+	return stopErr
+}
+
+// reconfigure stops the stream, applies a new format, and restarts it,
+// under the write lock so pump never sees a half-applied format.
+func (d *device) reconfigure(width, height, pixelformat uint32, numBuffers int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.stop(); err != nil {
+		return err
+	}
+	if err := d.setFormat(width, height, pixelformat, numBuffers); err != nil {
+		return err
+	}
+	return d.start()
+}
+
+// setFrameInterval requests a capture frame rate of fps frames per
+// second. Not all drivers honor this; callers should treat it as
+// advisory.
+func (d *device) setFrameInterval(fps uint32) error {
+	return v4l2.SetFrameInterval(d.fd, fps)
+}
+
+// pump continuously dequeues and re-enqueues buffers, recording each
+// completed frame in the ring, until ctx is cancelled. Each wait for a
+// frame is bounded by pollTimeout so cancellation is noticed promptly
+// rather than blocking forever in poll().
+func (d *device) pump(ctx context.Context) error {
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err := v4l2.Poll(d.fd, pollTimeout)
+		if errors.Is(err, v4l2.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			stats.recordIoctlError(err)
+			return err
+		}
+		pollReturned := time.Now()
+
+		d.mu.RLock()
+		qbuf, err := v4l2.DQBuf(d.fd)
+		if err != nil {
+			d.mu.RUnlock()
+			if errors.Is(err, v4l2.ErrNoBuffer) {
+				continue
+			}
+			stats.recordIoctlError(err)
+			return err
+		}
+		dqbufLatency := time.Since(pollReturned)
+		atomic.AddUint64(&stats.framesDequeued, 1)
+
+		if index := int(qbuf.Index); index < len(d.buffers) {
+			raw := d.buffers[index][:qbuf.BytesUsed]
+			buf := d.jpegBuf[index]
+			if err := d.encoder.Encode(raw, buf); err != nil {
+				log.Println("encode:", err)
+			} else {
+				d.frames.complete(index, buf.Bytes())
+				stats.recordFrame(buf.Len(), dqbufLatency)
+			}
+		}
+
+		err = v4l2.QBuf(d.fd, &qbuf)
+		d.mu.RUnlock()
+		if err != nil {
+			stats.recordIoctlError(err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Software JPEG encoding for cameras that don't natively emit JPEG
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+)
+
+// jpegQuality is used for all software-encoded JPEGs.
+const jpegQuality = 90
+
+// Encoder converts one dequeued capture buffer into a JPEG image,
+// replacing dst's previous contents with it. Implementations may reuse internal scratch state
+// across calls, so a single Encoder must not be used from more than one
+// goroutine at a time.
+type Encoder interface {
+	Encode(src []byte, dst *bytes.Buffer) error
+}
+
+// passthroughEncoder is used when the device already emits JPEG (or
+// MJPEG, which is a JPEG per frame): the buffer is copied to dst
+// unmodified.
+type passthroughEncoder struct{}
+
+func (passthroughEncoder) Encode(src []byte, dst *bytes.Buffer) error {
+	dst.Reset()
+	_, err := dst.Write(src)
+	return err
+}
+
+// yuvEncoder JPEG-encodes a raw YUYV or NV12 buffer by converting it
+// into a pooled image.YCbCr, sized once for the negotiated resolution,
+// so repeated calls don't allocate a new image.
+type yuvEncoder struct {
+	width, height int
+	img           *image.YCbCr
+	convert       func(src []byte, img *image.YCbCr)
+}
+
+func newYUYVEncoder(width, height int) *yuvEncoder {
+	return &yuvEncoder{
+		width:   width,
+		height:  height,
+		img:     image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio422),
+		convert: yuyvToYCbCr,
+	}
+}
+
+func newNV12Encoder(width, height int) *yuvEncoder {
+	return &yuvEncoder{
+		width:   width,
+		height:  height,
+		img:     image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420),
+		convert: nv12ToYCbCr,
+	}
+}
+
+func (e *yuvEncoder) Encode(src []byte, dst *bytes.Buffer) error {
+	e.convert(src, e.img)
+	dst.Reset()
+	return jpeg.Encode(dst, e.img, &jpeg.Options{Quality: jpegQuality})
+}
+
+// yuyvToYCbCr unpacks a YUYV (4:2:2) buffer into img's Y/Cb/Cr planes.
+// YUYV packs two luma samples per four bytes: Y0 U Y1 V.
+func yuyvToYCbCr(src []byte, img *image.YCbCr) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < h; y++ {
+		srcRow := src[y*w*2:]
+		yRow := img.Y[y*img.YStride:]
+		cRow := y * img.CStride
+		for x := 0; x+1 < w; x += 2 {
+			i := x * 2
+			yRow[x] = srcRow[i]
+			yRow[x+1] = srcRow[i+2]
+			img.Cb[cRow+x/2] = srcRow[i+1]
+			img.Cr[cRow+x/2] = srcRow[i+3]
+		}
+	}
+}
+
+// nv12ToYCbCr splits an NV12 buffer (a full-resolution Y plane followed
+// by an interleaved, half-resolution CbCr plane) into img's planes.
+func nv12ToYCbCr(src []byte, img *image.YCbCr) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	copy(img.Y, src[:w*h])
+
+	uv := src[w*h:]
+	cw, ch := (w+1)/2, (h+1)/2
+	for y := 0; y < ch; y++ {
+		uvRow := uv[y*w:]
+		cRow := y * img.CStride
+		for x := 0; x < cw; x++ {
+			img.Cb[cRow+x] = uvRow[x*2]
+			img.Cr[cRow+x] = uvRow[x*2+1]
+		}
+	}
+}
+
+// rgbEncoder JPEG-encodes a raw RGB24 buffer by converting it into a
+// pooled image.RGBA, sized once for the negotiated resolution.
+type rgbEncoder struct {
+	width, height int
+	img           *image.RGBA
+}
+
+func newRGBEncoder(width, height int) *rgbEncoder {
+	return &rgbEncoder{width, height, image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+func (e *rgbEncoder) Encode(src []byte, dst *bytes.Buffer) error {
+	rgb24ToRGBA(src, e.img)
+	dst.Reset()
+	return jpeg.Encode(dst, e.img, &jpeg.Options{Quality: jpegQuality})
+}
+
+// rgb24ToRGBA expands a packed RGB24 buffer into img's RGBA plane,
+// filling alpha as opaque.
+func rgb24ToRGBA(src []byte, img *image.RGBA) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := 0; y < h; y++ {
+		srcRow := src[y*w*3:]
+		dstRow := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			dstRow[x*4+0] = srcRow[x*3+0]
+			dstRow[x*4+1] = srcRow[x*3+1]
+			dstRow[x*4+2] = srcRow[x*3+2]
+			dstRow[x*4+3] = 255
+		}
+	}
+}
+
+// newEncoder selects the Encoder for a negotiated pixel format. JPEG,
+// MJPEG, and H.264 are already compressed on the wire the driver hands
+// us, so they pass through unmodified; only raw formats need converting.
+func newEncoder(width, height int, pixelformat uint32) (Encoder, error) {
+	switch pixelformat {
+	case fourCCCode("JPEG"), fourCCCode("MJPG"), fourCCCode("H264"):
+		return passthroughEncoder{}, nil
+	case fourCCCode("YUYV"):
+		return newYUYVEncoder(width, height), nil
+	case fourCCCode("NV12"):
+		return newNV12Encoder(width, height), nil
+	case fourCCCode("RGB3"):
+		return newRGBEncoder(width, height), nil
+	default:
+		return nil, fmt.Errorf("no software JPEG encoder for pixel format %s", fourCCString(pixelformat))
+	}
+}
@@ -0,0 +1,187 @@
+// Format/resolution enumeration and runtime reconfiguration
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/thinkski/frameserver/v4l2"
+)
+
+// FrameSize describes one WxH the device supports for a given pixel
+// format, and the discrete frame rates (as "numerator/denominator"
+// fractions of a second per frame) available at that size.
+type FrameSize struct {
+	Width  uint32   `json:"width"`
+	Height uint32   `json:"height"`
+	FPS    []string `json:"fps,omitempty"`
+}
+
+// FormatInfo describes one pixel format the device supports.
+type FormatInfo struct {
+	PixelFormat string      `json:"pixelformat"`
+	Description string      `json:"description"`
+	Sizes       []FrameSize `json:"sizes"`
+}
+
+// fourCCString decodes a V4L2 FourCC pixel format code into its
+// four-character string form, e.g. "YUYV" or "MJPG".
+func fourCCString(code uint32) string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, code)
+	return string(b)
+}
+
+// fourCCCode encodes a four-character string into a V4L2 FourCC code.
+func fourCCCode(s string) uint32 {
+	b := []byte(s)
+	for len(b) < 4 {
+		b = append(b, ' ')
+	}
+	return binary.LittleEndian.Uint32(b[:4])
+}
+
+// probeFormats enumerates every pixel format, frame size, and (for
+// discrete sizes) frame interval the device advertises.
+func probeFormats(fd int) ([]FormatInfo, error) {
+	var formats []FormatInfo
+
+	for fidx := uint32(0); ; fidx++ {
+		fdesc, err := v4l2.EnumFmt(fd, fidx)
+		if isEnumDone(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info := FormatInfo{
+			PixelFormat: fourCCString(fdesc.PixelFormat),
+			Description: uint8_to_string(fdesc.Description[:]),
+		}
+
+		for sidx := uint32(0); ; sidx++ {
+			fsize, err := v4l2.EnumFrameSizes(fd, fdesc.PixelFormat, sidx)
+			if isEnumDone(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if fsize.Type != v4l2.FrmSizeTypeDiscrete {
+				// Stepwise/continuous ranges aren't enumerable as a
+				// fixed list; report nothing further for this format.
+				break
+			}
+
+			size := FrameSize{
+				Width:  binary.LittleEndian.Uint32(fsize.Union[0:4]),
+				Height: binary.LittleEndian.Uint32(fsize.Union[4:8]),
+			}
+
+			for iidx := uint32(0); ; iidx++ {
+				fival, err := v4l2.EnumFrameIntervals(fd, fdesc.PixelFormat, size.Width, size.Height, iidx)
+				if isEnumDone(err) {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				if fival.Type != v4l2.FrmIvalTypeDiscrete {
+					break
+				}
+
+				num := binary.LittleEndian.Uint32(fival.Union[0:4])
+				den := binary.LittleEndian.Uint32(fival.Union[4:8])
+				size.FPS = append(size.FPS, fmt.Sprintf("%d/%d", num, den))
+			}
+
+			info.Sizes = append(info.Sizes, size)
+		}
+
+		formats = append(formats, info)
+	}
+
+	return formats, nil
+}
+
+// isEnumDone reports whether err is the EINVAL a VIDIOC_ENUM_* ioctl
+// returns once index runs past the last available entry.
+func isEnumDone(err error) bool {
+	var reqErr *v4l2.RequestError
+	return errors.As(err, &reqErr) && errors.Is(reqErr.Err, unix.EINVAL)
+}
+
+// formatsJSON returns an http handler serving the device's driver info
+// alongside its supported pixel formats, sizes, and frame rates, as
+// JSON.
+func formatsJSON(d *device) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		formats, err := probeFormats(d.fd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Driver  string       `json:"driver"`
+			Card    string       `json:"card"`
+			Formats []FormatInfo `json:"formats"`
+		}{d.driver, d.card, formats})
+	})
+}
+
+// configRequest is the JSON body accepted by POST /config.
+type configRequest struct {
+	Width       uint32 `json:"width"`
+	Height      uint32 `json:"height"`
+	PixelFormat string `json:"pixelformat"`
+	FPS         uint32 `json:"fps"`
+}
+
+// configHandler applies a new format/resolution/frame rate at runtime,
+// cycling STREAMOFF -> munmap -> S_FMT -> REQBUFS -> QUERYBUF -> mmap ->
+// QBUF -> STREAMON under the device's write lock.
+func configHandler(d *device, numBuffers int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var cfg configRequest
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.PixelFormat == "" {
+			http.Error(w, "pixelformat is required", http.StatusBadRequest)
+			return
+		}
+
+		if err := d.reconfigure(cfg.Width, cfg.Height, fourCCCode(cfg.PixelFormat), numBuffers); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if cfg.FPS != 0 {
+			if err := d.setFrameInterval(cfg.FPS); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Width       uint32 `json:"width"`
+			Height      uint32 `json:"height"`
+			PixelFormat string `json:"pixelformat"`
+		}{d.width, d.height, fourCCString(d.pixelformat)})
+	})
+}
@@ -0,0 +1,122 @@
+// Minimal baseline JPEG marker parser, just enough to RTP/JPEG (RFC
+// 2435) packetize a frame without re-encoding it.
+package main
+
+import "fmt"
+
+// jpegInfo is what RFC 2435 packetization needs out of a JPEG frame:
+// its dimensions, sampling type, quantization tables, and the raw
+// entropy-coded scan data (everything after the SOS header, without
+// the trailing EOI marker).
+type jpegInfo struct {
+	width, height int
+	typ           uint8 // 0 = 4:2:2 subsampling, 1 = 4:2:0
+	qtables       []byte
+	scan          []byte
+}
+
+// parseJPEG walks a JFIF/Exif-free baseline JPEG's markers to collect
+// the fields RFC 2435 requires. It does not decode pixels.
+func parseJPEG(data []byte) (*jpegInfo, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, fmt.Errorf("not a JPEG (missing SOI)")
+	}
+
+	info := &jpegInfo{}
+	var tables [2][64]byte // index 0: luma, index 1: chroma
+	haveLuma, haveChroma := false, false
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil, fmt.Errorf("malformed marker at offset %d", i)
+		}
+		marker := data[i+1]
+		i += 2
+
+		switch marker {
+		case 0xd8, 0xd9, 0x01:
+			continue
+		}
+		if marker >= 0xd0 && marker <= 0xd7 {
+			continue
+		}
+
+		if i+2 > len(data) {
+			return nil, fmt.Errorf("truncated segment length")
+		}
+		length := int(data[i])<<8 | int(data[i+1])
+		if i+length > len(data) {
+			return nil, fmt.Errorf("truncated segment body")
+		}
+		segment := data[i+2 : i+length]
+
+		switch marker {
+		case 0xdb: // DQT, possibly several tables back to back
+			for len(segment) >= 65 {
+				precision := segment[0] >> 4
+				id := segment[0] & 0x0f
+				if precision != 0 {
+					return nil, fmt.Errorf("16-bit quantization tables unsupported")
+				}
+				if id == 0 {
+					copy(tables[0][:], segment[1:65])
+					haveLuma = true
+				} else if id == 1 {
+					copy(tables[1][:], segment[1:65])
+					haveChroma = true
+				}
+				segment = segment[65:]
+			}
+
+		case 0xc0, 0xc1: // SOF0/SOF1, baseline
+			if len(segment) < 6 {
+				return nil, fmt.Errorf("truncated SOF")
+			}
+			info.height = int(segment[1])<<8 | int(segment[2])
+			info.width = int(segment[3])<<8 | int(segment[4])
+			numComponents := int(segment[5])
+			if numComponents != 3 || len(segment) < 6+numComponents*3 {
+				return nil, fmt.Errorf("only 3-component (YCbCr) JPEG is supported")
+			}
+			ySample := segment[6+1]
+			h, v := ySample>>4, ySample&0x0f
+			switch {
+			case h == 2 && v == 1:
+				info.typ = 0 // 4:2:2
+			case h == 2 && v == 2:
+				info.typ = 1 // 4:2:0
+			default:
+				return nil, fmt.Errorf("unsupported chroma subsampling %dx%d", h, v)
+			}
+
+		case 0xda: // SOS: header ends, entropy-coded data follows
+			scanStart := i + length
+			scanEnd := len(data)
+			if scanEnd >= 2 && data[scanEnd-2] == 0xff && data[scanEnd-1] == 0xd9 {
+				scanEnd -= 2
+			}
+			info.scan = data[scanStart:scanEnd]
+			i = len(data)
+			continue
+		}
+
+		i += length
+	}
+
+	if info.scan == nil {
+		return nil, fmt.Errorf("no scan data (missing SOS)")
+	}
+	if info.width == 0 || info.height == 0 {
+		return nil, fmt.Errorf("no dimensions (missing SOF0)")
+	}
+	if !haveLuma || !haveChroma {
+		return nil, fmt.Errorf("missing quantization tables")
+	}
+
+	info.qtables = make([]byte, 0, 128)
+	info.qtables = append(info.qtables, tables[0][:]...)
+	info.qtables = append(info.qtables, tables[1][:]...)
+
+	return info, nil
+}
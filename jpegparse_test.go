@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// marker builds a JFIF segment: 0xff, the marker byte, a big-endian
+// length (including the two length bytes themselves), then body.
+func marker(m byte, body []byte) []byte {
+	length := len(body) + 2
+	return append([]byte{0xff, m, byte(length >> 8), byte(length)}, body...)
+}
+
+// dqt builds a DQT segment (precision/id nibble, then a 64-byte table).
+func dqt(id byte) []byte {
+	table := make([]byte, 64)
+	for i := range table {
+		table[i] = byte(i)
+	}
+	return marker(0xdb, append([]byte{id}, table...))
+}
+
+// sof0 builds a baseline SOF0 segment for one 3-component image with
+// the given luma sampling factors.
+func sof0(width, height int, hSample, vSample byte) []byte {
+	body := []byte{
+		8, // precision
+		byte(height >> 8), byte(height),
+		byte(width >> 8), byte(width),
+		3, // number of components
+		1, hSample<<4 | vSample, 0, // Y
+		2, 0x11, 1, // Cb
+		3, 0x11, 1, // Cr
+	}
+	return marker(0xc0, body)
+}
+
+func buildJPEG(width, height int, hSample, vSample byte, scan []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xd8}) // SOI
+	buf.Write(dqt(0))
+	buf.Write(dqt(1))
+	buf.Write(sof0(width, height, hSample, vSample))
+	buf.Write(marker(0xda, []byte{3, 1, 0, 2, 0x11, 3, 0x11, 0, 63, 0})) // minimal SOS header
+	buf.Write(scan)
+	buf.Write([]byte{0xff, 0xd9}) // EOI
+	return buf.Bytes()
+}
+
+func TestParseJPEG(t *testing.T) {
+	cases := []struct {
+		name          string
+		hSample       byte
+		vSample       byte
+		wantTyp       uint8
+		wantErrSubstr string
+	}{
+		{name: "4:2:2", hSample: 2, vSample: 1, wantTyp: 0},
+		{name: "4:2:0", hSample: 2, vSample: 2, wantTyp: 1},
+		{name: "unsupported 4:4:4", hSample: 1, vSample: 1, wantErrSubstr: "unsupported chroma subsampling"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scan := []byte{0x12, 0x34, 0x56, 0x78}
+			data := buildJPEG(16, 8, c.hSample, c.vSample, scan)
+
+			info, err := parseJPEG(data)
+			if c.wantErrSubstr != "" {
+				if err == nil || !bytes.Contains([]byte(err.Error()), []byte(c.wantErrSubstr)) {
+					t.Fatalf("parseJPEG() err = %v, want containing %q", err, c.wantErrSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJPEG() unexpected error: %v", err)
+			}
+			if info.width != 16 || info.height != 8 {
+				t.Errorf("dimensions = %dx%d, want 16x8", info.width, info.height)
+			}
+			if info.typ != c.wantTyp {
+				t.Errorf("typ = %d, want %d", info.typ, c.wantTyp)
+			}
+			if len(info.qtables) != 128 {
+				t.Errorf("len(qtables) = %d, want 128", len(info.qtables))
+			}
+			if !bytes.Equal(info.scan, scan) {
+				t.Errorf("scan = %x, want %x", info.scan, scan)
+			}
+		})
+	}
+}
+
+func TestParseJPEGMissingSOI(t *testing.T) {
+	if _, err := parseJPEG([]byte{0x00, 0x01, 0x02}); err == nil {
+		t.Fatal("parseJPEG() on data without an SOI marker returned no error")
+	}
+}
+
+func TestParseJPEGMissingQuantizationTables(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xd8})
+	buf.Write(sof0(16, 8, 2, 1))
+	buf.Write(marker(0xda, []byte{3, 1, 0, 2, 0x11, 3, 0x11, 0, 63, 0}))
+	buf.Write([]byte{0x12, 0x34})
+	buf.Write([]byte{0xff, 0xd9})
+
+	if _, err := parseJPEG(buf.Bytes()); err == nil {
+		t.Fatal("parseJPEG() on data without DQT markers returned no error")
+	}
+}
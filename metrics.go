@@ -0,0 +1,168 @@
+// Prometheus-format capture and delivery statistics
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thinkski/frameserver/v4l2"
+)
+
+// dqbufLatencyBucketsMs are the histogram bucket upper bounds, in
+// milliseconds, for the DQBUF latency metric.
+var dqbufLatencyBucketsMs = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// numDQBufBuckets is len(dqbufLatencyBucketsMs)+1 (the +1 for the +Inf
+// bucket), spelled out as a constant so it can size a fixed array.
+const numDQBufBuckets = 11
+
+// metrics holds allocation-free, atomically-updated counters and
+// gauges for capture and delivery. Values are only formatted as
+// Prometheus text when /metrics is scraped, so the hot path (pump,
+// getJPEG, streamMJPEG) never allocates to record them.
+type metrics struct {
+	framesDequeued uint64
+	framesDropped  uint64
+	lastFrameBytes uint64
+	activeClients  int64
+
+	fpsBits     uint64 // math.Float64bits of an EWMA, accessed atomically
+	lastFrameAt int64  // UnixNano of the previous recorded frame
+
+	dqbufBuckets  [numDQBufBuckets]uint64
+	dqbufSumNanos uint64
+	dqbufCount    uint64
+
+	ioctlErrMu  sync.Mutex
+	ioctlErrors map[string]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{ioctlErrors: make(map[string]uint64)}
+}
+
+// stats is the process-wide metrics instance.
+var stats = newMetrics()
+
+// recordFrame updates the last frame size, the fps EWMA, and the DQBUF
+// latency histogram for one successfully encoded frame. framesDequeued
+// is counted by pump itself, for every dequeued buffer.
+func (m *metrics) recordFrame(bytesLen int, dqbufLatency time.Duration) {
+	atomic.StoreUint64(&m.lastFrameBytes, uint64(bytesLen))
+	m.recordFPS()
+	m.recordLatency(dqbufLatency)
+}
+
+// recordFPS folds the time since the previous frame into an
+// exponential moving average of frames per second.
+func (m *metrics) recordFPS() {
+	now := time.Now().UnixNano()
+	prev := atomic.SwapInt64(&m.lastFrameAt, now)
+	if prev == 0 {
+		return
+	}
+	dt := float64(now-prev) / float64(time.Second)
+	if dt <= 0 {
+		return
+	}
+	instant := 1 / dt
+
+	const alpha = 0.2
+	for {
+		oldBits := atomic.LoadUint64(&m.fpsBits)
+		old := math.Float64frombits(oldBits)
+		next := instant
+		if old != 0 {
+			next = alpha*instant + (1-alpha)*old
+		}
+		if atomic.CompareAndSwapUint64(&m.fpsBits, oldBits, math.Float64bits(next)) {
+			return
+		}
+	}
+}
+
+func (m *metrics) recordLatency(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	for i, le := range dqbufLatencyBucketsMs {
+		if ms <= le {
+			atomic.AddUint64(&m.dqbufBuckets[i], 1)
+		}
+	}
+	atomic.AddUint64(&m.dqbufBuckets[len(dqbufLatencyBucketsMs)], 1) // +Inf
+	atomic.AddUint64(&m.dqbufSumNanos, uint64(d.Nanoseconds()))
+	atomic.AddUint64(&m.dqbufCount, 1)
+}
+
+func (m *metrics) recordDropped(n uint64) {
+	if n > 0 {
+		atomic.AddUint64(&m.framesDropped, n)
+	}
+}
+
+// recordIoctlError attributes a failed ioctl to its request name, or
+// "unknown" if err didn't come from the v4l2 package.
+func (m *metrics) recordIoctlError(err error) {
+	name := "unknown"
+	var reqErr *v4l2.RequestError
+	if errors.As(err, &reqErr) {
+		name = reqErr.Request
+	}
+
+	m.ioctlErrMu.Lock()
+	m.ioctlErrors[name]++
+	m.ioctlErrMu.Unlock()
+}
+
+func (m *metrics) clientConnected()    { atomic.AddInt64(&m.activeClients, 1) }
+func (m *metrics) clientDisconnected() { atomic.AddInt64(&m.activeClients, -1) }
+
+// metricsHandler returns an http handler serving m in Prometheus text
+// exposition format.
+func metricsHandler(m *metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintln(w, "# HELP frameserver_frames_dequeued_total Frames dequeued from the capture device.")
+		fmt.Fprintln(w, "# TYPE frameserver_frames_dequeued_total counter")
+		fmt.Fprintf(w, "frameserver_frames_dequeued_total %d\n", atomic.LoadUint64(&m.framesDequeued))
+
+		fmt.Fprintln(w, "# HELP frameserver_frames_dropped_total Frames a slow streaming client never read before a newer one replaced it.")
+		fmt.Fprintln(w, "# TYPE frameserver_frames_dropped_total counter")
+		fmt.Fprintf(w, "frameserver_frames_dropped_total %d\n", atomic.LoadUint64(&m.framesDropped))
+
+		fmt.Fprintln(w, "# HELP frameserver_last_frame_bytes Size in bytes of the most recently encoded frame.")
+		fmt.Fprintln(w, "# TYPE frameserver_last_frame_bytes gauge")
+		fmt.Fprintf(w, "frameserver_last_frame_bytes %d\n", atomic.LoadUint64(&m.lastFrameBytes))
+
+		fmt.Fprintln(w, "# HELP frameserver_fps Exponential moving average of the capture frame rate.")
+		fmt.Fprintln(w, "# TYPE frameserver_fps gauge")
+		fmt.Fprintf(w, "frameserver_fps %f\n", math.Float64frombits(atomic.LoadUint64(&m.fpsBits)))
+
+		fmt.Fprintln(w, "# HELP frameserver_stream_clients Active streaming clients (MJPEG, RTSP, or WebRTC, depending on -out).")
+		fmt.Fprintln(w, "# TYPE frameserver_stream_clients gauge")
+		fmt.Fprintf(w, "frameserver_stream_clients %d\n", atomic.LoadInt64(&m.activeClients))
+
+		fmt.Fprintln(w, "# HELP frameserver_dqbuf_latency_seconds Time between poll() returning readable and VIDIOC_DQBUF completing.")
+		fmt.Fprintln(w, "# TYPE frameserver_dqbuf_latency_seconds histogram")
+		for i, le := range dqbufLatencyBucketsMs {
+			fmt.Fprintf(w, "frameserver_dqbuf_latency_seconds_bucket{le=\"%g\"} %d\n", le/1000, atomic.LoadUint64(&m.dqbufBuckets[i]))
+		}
+		count := atomic.LoadUint64(&m.dqbufCount)
+		fmt.Fprintf(w, "frameserver_dqbuf_latency_seconds_bucket{le=\"+Inf\"} %d\n", count)
+		fmt.Fprintf(w, "frameserver_dqbuf_latency_seconds_sum %f\n", float64(atomic.LoadUint64(&m.dqbufSumNanos))/float64(time.Second))
+		fmt.Fprintf(w, "frameserver_dqbuf_latency_seconds_count %d\n", count)
+
+		fmt.Fprintln(w, "# HELP frameserver_ioctl_errors_total Cumulative ioctl errors by request name.")
+		fmt.Fprintln(w, "# TYPE frameserver_ioctl_errors_total counter")
+		m.ioctlErrMu.Lock()
+		for name, errCount := range m.ioctlErrors {
+			fmt.Fprintf(w, "frameserver_ioctl_errors_total{request=\"%s\"} %d\n", name, errCount)
+		}
+		m.ioctlErrMu.Unlock()
+	})
+}
@@ -0,0 +1,72 @@
+// MJPEG multipart streaming handler
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// mjpegBoundary separates parts of the multipart/x-mixed-replace stream.
+const mjpegBoundary = "frameserverboundary"
+
+// streamMJPEG returns an http.Handler that pushes each newly completed
+// frame to the client as a multipart/x-mixed-replace part. A client that
+// reads slower than the capture rate simply sees the newest frame on its
+// next read; frames it didn't get to are dropped rather than queued.
+// ctx is the process-wide shutdown context: without it, a client parked
+// here would never notice the capture pump stopping on shutdown, since
+// nothing would be left to wake frames.wait.
+func streamMJPEG(ctx context.Context, d *device) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		stats.clientConnected()
+		defer stats.clientDisconnected()
+
+		var lastSeq uint64
+		var frames *ring
+		for {
+			d.mu.RLock()
+			curFrames := d.frames
+			d.mu.RUnlock()
+
+			// A runtime reconfiguration (POST /config) swaps in a new
+			// ring; reset pacing so we don't wait on stale sequence
+			// numbers from the old one.
+			if curFrames != frames {
+				frames = curFrames
+				lastSeq = 0
+			}
+
+			frame, seq, err := frames.wait(ctx, lastSeq)
+			if err != nil {
+				return
+			}
+			if lastSeq != 0 && seq > lastSeq+1 {
+				stats.recordDropped(seq - lastSeq - 1)
+			}
+			lastSeq = seq
+
+			if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", mjpegBoundary, len(frame)); err != nil {
+				return
+			}
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+			if _, err := w.Write([]byte("\r\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
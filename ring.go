@@ -0,0 +1,102 @@
+// Multi-buffer frame ring shared between the capture pump and HTTP handlers
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ring tracks, for each mmap'd capture buffer slot, the ring's own copy
+// of the most recently completed frame and its sequence number. wait
+// and newest hand callers a private copy of the frame bytes, taken
+// under the ring's lock, so a slow client reading frame i is never torn
+// by the writer reusing slot i (via the same pooled encode buffer) for
+// a later frame while the client's write is still in flight.
+type ring struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	frame  [][]byte // frame[i] is the ring's own copy of the frame last completed into slot i
+	length []uint32
+	seq    []uint64
+	latest int
+	curSeq uint64
+}
+
+// newRing allocates a ring tracking n capture buffers.
+func newRing(n int) *ring {
+	r := &ring{
+		frame:  make([][]byte, n),
+		length: make([]uint32, n),
+		seq:    make([]uint64, n),
+		latest: -1,
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// complete records that buffer index has just been filled with frame,
+// copying it into the ring's own per-slot storage (reusing previously
+// allocated capacity where possible) and wakes any clients waiting on a
+// newer frame.
+func (r *ring) complete(index int, frame []byte) {
+	r.mu.Lock()
+	r.frame[index] = append(r.frame[index][:0], frame...)
+	r.curSeq++
+	r.length[index] = uint32(len(frame))
+	r.seq[index] = r.curSeq
+	r.latest = index
+	r.mu.Unlock()
+	r.cond.Broadcast()
+}
+
+// wait blocks until a frame newer than lastSeq is available, then
+// returns a copy of it along with its sequence number. It returns
+// early with ctx.Err() if ctx is done first — without this, a client
+// connected when the capture pump stops (ctx cancelled, e.g. on
+// shutdown) would have nothing left to ever broadcast it awake.
+func (r *ring) wait(ctx context.Context, lastSeq uint64) (frame []byte, seq uint64, err error) {
+	// sync.Cond has no cancellation of its own, so a goroutine bridges
+	// ctx.Done() into a Broadcast the Wait loop below can notice.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Taking r.mu ensures the waiter is either inside Wait or
+			// not yet at its ctx check, so the wakeup is never lost.
+			r.mu.Lock()
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.latest < 0 || r.seq[r.latest] <= lastSeq {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		r.cond.Wait()
+	}
+	return r.copyLocked(r.latest), r.seq[r.latest], nil
+}
+
+// newest returns a copy of the most recently completed frame and its
+// sequence number, or ok == false if no frame has completed yet.
+func (r *ring) newest() (frame []byte, seq uint64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.latest < 0 {
+		return nil, 0, false
+	}
+	return r.copyLocked(r.latest), r.seq[r.latest], true
+}
+
+// copyLocked returns a fresh copy of slot index's frame. Callers must
+// hold r.mu.
+func (r *ring) copyLocked(index int) []byte {
+	frame := make([]byte, r.length[index])
+	copy(frame, r.frame[index][:r.length[index]])
+	return frame
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRingNewestEmpty(t *testing.T) {
+	r := newRing(2)
+	if _, _, ok := r.newest(); ok {
+		t.Fatal("newest() on an empty ring returned ok = true")
+	}
+}
+
+func TestRingCompleteAndNewest(t *testing.T) {
+	r := newRing(2)
+
+	r.complete(0, []byte("frame0"))
+	r.complete(1, []byte("frame1"))
+
+	frame, seq, ok := r.newest()
+	if !ok {
+		t.Fatal("newest() returned ok = false after two completes")
+	}
+	if string(frame) != "frame1" {
+		t.Errorf("newest() frame = %q, want %q", frame, "frame1")
+	}
+	if seq != 2 {
+		t.Errorf("newest() seq = %d, want 2", seq)
+	}
+}
+
+func TestRingSeqIsMonotonicAcrossSlots(t *testing.T) {
+	r := newRing(2)
+
+	for i, want := range []uint64{1, 2, 3, 4} {
+		r.complete(i%2, []byte("x"))
+		if _, seq, _ := r.newest(); seq != want {
+			t.Fatalf("after complete #%d: seq = %d, want %d", i, seq, want)
+		}
+	}
+}
+
+func TestRingWaitBlocksUntilNewerFrame(t *testing.T) {
+	r := newRing(1)
+	r.complete(0, []byte("first"))
+
+	done := make(chan struct{})
+	var frame []byte
+	var seq uint64
+	go func() {
+		frame, seq, _ = r.wait(context.Background(), 1) // already have seq 1; should block for seq 2
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("wait(1) returned before a newer frame was completed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	r.complete(0, []byte("second"))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait(1) did not return after a newer frame was completed")
+	}
+
+	if string(frame) != "second" {
+		t.Errorf("wait(1) frame = %q, want %q", frame, "second")
+	}
+	if seq != 2 {
+		t.Errorf("wait(1) seq = %d, want 2", seq)
+	}
+}
+
+// TestRingCopiesAreIsolated guards against the frame-tearing bug where a
+// reader aliased the same backing array the capture pump reused on a
+// later frame: mutating the slice passed to complete, or a frame
+// returned by a previous wait/newest, must never change what a caller
+// sees afterward.
+func TestRingCopiesAreIsolated(t *testing.T) {
+	r := newRing(1)
+
+	src := []byte("original")
+	r.complete(0, src)
+	src[0] = 'X' // simulate the encoder reusing its buffer
+
+	frame, _, ok := r.newest()
+	if !ok {
+		t.Fatal("newest() returned ok = false")
+	}
+	if string(frame) != "original" {
+		t.Errorf("newest() frame = %q, want %q (mutating the source after complete() leaked through)", frame, "original")
+	}
+
+	frame[0] = 'Y' // callers must not be able to corrupt the ring's copy either
+	frame2, _, _ := r.newest()
+	if string(frame2) != "original" {
+		t.Errorf("second newest() frame = %q, want %q (mutating a returned frame leaked into the ring)", frame2, "original")
+	}
+}
+
+// TestRingWaitReturnsOnContextCancellation guards against the shutdown
+// hang this was added to fix: a client parked in wait() when the
+// capture pump stops producing frames (e.g. on SIGINT) must be woken by
+// ctx being cancelled, not left blocked forever with nothing left to
+// ever Broadcast.
+func TestRingWaitReturnsOnContextCancellation(t *testing.T) {
+	r := newRing(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := r.wait(ctx, 0)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("wait() returned before ctx was cancelled or a frame completed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("wait() returned a nil error after ctx was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait() did not return after ctx was cancelled")
+	}
+}
+
+// TestRingDropDetection exercises the seq-gap arithmetic streamMJPEG,
+// the RTSP streamer, and the WebRTC streamer all use to count frames a
+// slow client never saw.
+func TestRingDropDetection(t *testing.T) {
+	r := newRing(2)
+
+	r.complete(0, []byte("a"))
+	lastSeq := uint64(0)
+
+	frame, seq, err := r.wait(context.Background(), lastSeq)
+	if err != nil || string(frame) != "a" || seq != 1 {
+		t.Fatalf("wait(0) = (%q, %d, %v), want (\"a\", 1, nil)", frame, seq, err)
+	}
+	lastSeq = seq
+
+	// Three more frames complete before the client asks again.
+	r.complete(1, []byte("b"))
+	r.complete(0, []byte("c"))
+	r.complete(1, []byte("d"))
+
+	frame, seq, err = r.wait(context.Background(), lastSeq)
+	if err != nil || string(frame) != "d" || seq != 4 {
+		t.Fatalf("wait(1) = (%q, %d, %v), want (\"d\", 4, nil)", frame, seq, err)
+	}
+
+	dropped := seq - lastSeq - 1
+	if dropped != 2 {
+		t.Errorf("dropped = %d, want 2 (frames b and c)", dropped)
+	}
+}
@@ -0,0 +1,190 @@
+// RTP packetization: RFC 2435 (JPEG) and RFC 6184 (H.264)
+package main
+
+import (
+	"encoding/binary"
+	"math/rand"
+)
+
+const (
+	rtpVersion = 2
+
+	payloadTypeJPEG = 26
+	payloadTypeH264 = 96
+
+	rtpClockRate = 90000 // both JPEG and H.264 RTP use a 90kHz clock
+
+	// maxPayload keeps packets comfortably under a standard Ethernet
+	// MTU once the 12-byte RTP header (and, for interleaved RTSP, the
+	// 4-byte "$" framing) is added.
+	maxPayload = 1400
+)
+
+// rtpStream tracks the sequence number, SSRC, and payload type for one
+// outgoing RTP stream; callers supply each packet's timestamp. It is not
+// safe for concurrent use.
+type rtpStream struct {
+	ssrc uint32
+	seq  uint16
+	pt   uint8
+}
+
+func newRTPStream(pt uint8) *rtpStream {
+	return &rtpStream{ssrc: rand.Uint32(), seq: uint16(rand.Uint32()), pt: pt}
+}
+
+// packet appends a 12-byte RTP header to payload and returns the full
+// packet, advancing the stream's sequence number.
+func (s *rtpStream) packet(timestamp uint32, marker bool, payload []byte) []byte {
+	pkt := make([]byte, 12+len(payload))
+	pkt[0] = rtpVersion << 6
+	pkt[1] = s.pt
+	if marker {
+		pkt[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(pkt[2:4], s.seq)
+	binary.BigEndian.PutUint32(pkt[4:8], timestamp)
+	binary.BigEndian.PutUint32(pkt[8:12], s.ssrc)
+	copy(pkt[12:], payload)
+	s.seq++
+	return pkt
+}
+
+// packetizeJPEG splits one JPEG frame into RFC 2435 RTP packets.
+func (s *rtpStream) packetizeJPEG(frame []byte, timestamp uint32) ([][]byte, error) {
+	info, err := parseJPEG(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	var packets [][]byte
+	offset := 0
+	for offset < len(info.scan) {
+		// maxPayload bounds the whole payload: leave room for the 8-byte
+		// main header and, on the first packet, the quantization table
+		// header and tables.
+		room := maxPayload - 8
+		if offset == 0 {
+			room -= 4 + len(info.qtables)
+		}
+		end := offset + room
+		if end > len(info.scan) {
+			end = len(info.scan)
+		}
+		last := end == len(info.scan)
+
+		header := make([]byte, 8)
+		header[0] = 0 // type-specific
+		header[1] = byte(offset >> 16)
+		header[2] = byte(offset >> 8)
+		header[3] = byte(offset)
+		header[4] = info.typ
+		header[5] = 255 // Q >= 128: quantization tables follow on the first packet
+		header[6] = byte(info.width / 8)
+		header[7] = byte(info.height / 8)
+
+		var payload []byte
+		if offset == 0 {
+			qtHeader := make([]byte, 4)
+			qtHeader[0] = 0 // MBZ
+			qtHeader[1] = 0 // precision: 8-bit
+			binary.BigEndian.PutUint16(qtHeader[2:4], uint16(len(info.qtables)))
+			payload = append(payload, header...)
+			payload = append(payload, qtHeader...)
+			payload = append(payload, info.qtables...)
+		} else {
+			payload = append(payload, header...)
+		}
+		payload = append(payload, info.scan[offset:end]...)
+
+		packets = append(packets, s.packet(timestamp, last, payload))
+		offset = end
+	}
+
+	return packets, nil
+}
+
+// splitNALUs splits an Annex-B H.264 bitstream (NALUs separated by
+// 0x000001 or 0x00000001 start codes) into individual NALUs.
+func splitNALUs(stream []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	i := 0
+	for i < len(stream) {
+		if i+3 <= len(stream) && stream[i] == 0 && stream[i+1] == 0 && stream[i+2] == 1 {
+			if start >= 0 {
+				nalus = append(nalus, trimTrailingZeros(stream[start:i]))
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(stream) {
+		nalus = append(nalus, trimTrailingZeros(stream[start:]))
+	}
+	return nalus
+}
+
+// trimTrailingZeros drops the zero bytes a following 4-byte start code
+// (0x00000001) leaves at the end of the previous NALU's slice, since
+// splitNALUs only matches its last three bytes.
+func trimTrailingZeros(nalu []byte) []byte {
+	end := len(nalu)
+	for end > 0 && nalu[end-1] == 0 {
+		end--
+	}
+	return nalu[:end]
+}
+
+// packetizeH264 RTP-packetizes one access unit's NALUs per RFC 6184:
+// small NALUs go out as Single NAL Unit packets, larger ones are split
+// into FU-A fragments.
+func (s *rtpStream) packetizeH264(stream []byte, timestamp uint32) [][]byte {
+	nalus := splitNALUs(stream)
+	var packets [][]byte
+
+	for n, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		last := n == len(nalus)-1
+
+		if len(nalu) <= maxPayload {
+			packets = append(packets, s.packet(timestamp, last, nalu))
+			continue
+		}
+
+		// FU-A fragmentation
+		header := nalu[0]
+		nri := header & 0x60
+		typ := header & 0x1f
+		payload := nalu[1:]
+
+		for offset := 0; offset < len(payload); {
+			end := offset + (maxPayload - 2)
+			if end > len(payload) {
+				end = len(payload)
+			}
+			fuIndicator := nri | 28 // FU-A
+			fuHeader := typ
+			if offset == 0 {
+				fuHeader |= 0x80 // start bit
+			}
+			if end == len(payload) {
+				fuHeader |= 0x40 // end bit
+			}
+
+			frag := make([]byte, 0, 2+(end-offset))
+			frag = append(frag, fuIndicator, fuHeader)
+			frag = append(frag, payload[offset:end]...)
+
+			marker := last && end == len(payload)
+			packets = append(packets, s.packet(timestamp, marker, frag))
+			offset = end
+		}
+	}
+
+	return packets
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitNALUs(t *testing.T) {
+	cases := []struct {
+		name   string
+		stream []byte
+		want   [][]byte
+	}{
+		{
+			name:   "three-byte start codes",
+			stream: []byte{0, 0, 1, 0x67, 0xaa, 0, 0, 1, 0x68, 0xbb, 0xcc},
+			want:   [][]byte{{0x67, 0xaa}, {0x68, 0xbb, 0xcc}},
+		},
+		{
+			name:   "four-byte start code",
+			stream: []byte{0, 0, 0, 1, 0x65, 0x01, 0x02},
+			want:   [][]byte{{0x65, 0x01, 0x02}},
+		},
+		{
+			name:   "no start code",
+			stream: []byte{0x65, 0x01},
+			want:   nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := splitNALUs(c.stream)
+			if len(got) != len(c.want) {
+				t.Fatalf("splitNALUs() = %d NALUs, want %d (%v)", len(got), len(c.want), got)
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], c.want[i]) {
+					t.Errorf("NALU %d = %x, want %x", i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPacketizeH264SingleNALU(t *testing.T) {
+	s := newRTPStream(payloadTypeH264)
+	nalu := []byte{0x67, 0x01, 0x02, 0x03}
+	stream := append([]byte{0, 0, 0, 1}, nalu...)
+
+	packets := s.packetizeH264(stream, 1000)
+	if len(packets) != 1 {
+		t.Fatalf("packetizeH264() = %d packets, want 1", len(packets))
+	}
+
+	pkt := packets[0]
+	if !bytes.Equal(pkt[12:], nalu) {
+		t.Errorf("packet payload = %x, want %x (single NALU mode should carry the NALU unchanged)", pkt[12:], nalu)
+	}
+	if pkt[1]&0x80 == 0 {
+		t.Error("marker bit not set on the only (and therefore last) packet")
+	}
+}
+
+func TestPacketizeH264FUAFragmentation(t *testing.T) {
+	s := newRTPStream(payloadTypeH264)
+
+	header := byte(0x65) // nri=0x60, type=0x05 (IDR slice)
+	payload := bytes.Repeat([]byte{0xab}, maxPayload*2+10)
+	nalu := append([]byte{header}, payload...)
+	stream := append([]byte{0, 0, 0, 1}, nalu...)
+
+	packets := s.packetizeH264(stream, 2000)
+	if len(packets) < 2 {
+		t.Fatalf("packetizeH264() = %d packets, want >= 2 for a NALU larger than maxPayload", len(packets))
+	}
+
+	for i, pkt := range packets {
+		fuIndicator := pkt[12]
+		fuHeader := pkt[13]
+
+		if fuIndicator&0x1f != 28 {
+			t.Fatalf("packet %d: FU indicator type = %d, want 28 (FU-A)", i, fuIndicator&0x1f)
+		}
+		if fuIndicator&0x60 != header&0x60 {
+			t.Errorf("packet %d: NRI bits not preserved from the original NALU header", i)
+		}
+		if fuHeader&0x1f != header&0x1f {
+			t.Errorf("packet %d: FU header type = %d, want %d", i, fuHeader&0x1f, header&0x1f)
+		}
+
+		wantStart := i == 0
+		wantEnd := i == len(packets)-1
+		if (fuHeader&0x80 != 0) != wantStart {
+			t.Errorf("packet %d: start bit = %v, want %v", i, fuHeader&0x80 != 0, wantStart)
+		}
+		if (fuHeader&0x40 != 0) != wantEnd {
+			t.Errorf("packet %d: end bit = %v, want %v", i, fuHeader&0x40 != 0, wantEnd)
+		}
+		if (pkt[1]&0x80 != 0) != wantEnd {
+			t.Errorf("packet %d: RTP marker bit = %v, want %v (set only on the last fragment)", i, pkt[1]&0x80 != 0, wantEnd)
+		}
+	}
+
+	var reassembled []byte
+	for _, pkt := range packets {
+		reassembled = append(reassembled, pkt[14:]...)
+	}
+	if !bytes.Equal(reassembled, payload) {
+		t.Error("reassembling FU-A fragment bodies did not reproduce the original NALU payload")
+	}
+}
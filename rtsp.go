@@ -0,0 +1,246 @@
+// Minimal RTSP/1.0 server streaming RTP over the TCP-interleaved
+// transport described in RFC 2326 section 10.12, avoiding the need for
+// a second UDP port (and any NAT/firewall punch-through) for viewers.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// rtspChannelRTP is the interleaved channel number carrying RTP packets;
+// RTCP (channel+1) is accepted in SETUP but never sent.
+const rtspChannelRTP = 0
+
+// rtspServer accepts RTSP/1.0 connections on addr and streams d's frames
+// to each, RTP-packetized according to d's negotiated pixel format.
+type rtspServer struct {
+	addr string
+	d    *device
+}
+
+func newRTSPServer(addr string, d *device) *rtspServer {
+	return &rtspServer{addr: addr, d: d}
+}
+
+// serve listens until ctx is cancelled, handling each connection in its
+// own goroutine.
+func (s *rtspServer) serve(ctx context.Context) error {
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+// handle services one client connection until it sends TEARDOWN, closes
+// the socket, or ctx is cancelled.
+func (s *rtspServer) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	tp := textproto.NewReader(r)
+
+	for {
+		requestLine, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(requestLine)
+		if len(fields) != 3 {
+			return
+		}
+		method, uri := fields[0], fields[1]
+
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		cseq := header.Get("CSeq")
+
+		switch method {
+		case "OPTIONS":
+			s.respond(conn, cseq, 200, "OK", textproto.MIMEHeader{
+				"Public": {"OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN"},
+			}, nil)
+
+		case "DESCRIBE":
+			sdp := s.describe(uri)
+			s.respond(conn, cseq, 200, "OK", textproto.MIMEHeader{
+				"Content-Type": {"application/sdp"},
+			}, []byte(sdp))
+
+		case "SETUP":
+			transport := header.Get("Transport")
+			if !strings.Contains(transport, "RTP/AVP/TCP") {
+				s.respond(conn, cseq, 461, "Unsupported Transport", nil, nil)
+				continue
+			}
+			s.respond(conn, cseq, 200, "OK", textproto.MIMEHeader{
+				"Transport": {fmt.Sprintf("RTP/AVP/TCP;interleaved=%d-%d", rtspChannelRTP, rtspChannelRTP+1)},
+				"Session":   {"1"},
+			}, nil)
+
+		case "PLAY":
+			s.respond(conn, cseq, 200, "OK", textproto.MIMEHeader{
+				"Session": {"1"},
+			}, nil)
+			// Streaming occupies the connection until the client
+			// disconnects or tears down; no further requests are read.
+			s.stream(ctx, conn)
+			return
+
+		case "TEARDOWN":
+			s.respond(conn, cseq, 200, "OK", textproto.MIMEHeader{"Session": {"1"}}, nil)
+			return
+
+		default:
+			s.respond(conn, cseq, 501, "Not Implemented", nil, nil)
+		}
+	}
+}
+
+// describe builds the SDP session description for d's current format.
+func (s *rtspServer) describe(uri string) string {
+	s.d.mu.RLock()
+	pixelformat := s.d.pixelformat
+	s.d.mu.RUnlock()
+
+	media := "JPEG/90000"
+	if isH264(pixelformat) {
+		media = fmt.Sprintf("H264/%d", rtpClockRate)
+	}
+
+	return strings.Join([]string{
+		"v=0",
+		"o=- 0 0 IN IP4 0.0.0.0",
+		"s=frameserver",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		fmt.Sprintf("m=video 0 RTP/AVP %d", rtpPayloadType(pixelformat)),
+		fmt.Sprintf("a=rtpmap:%d %s", rtpPayloadType(pixelformat), media),
+		fmt.Sprintf("a=control:%s", uri),
+		"",
+	}, "\r\n")
+}
+
+// respond writes an RTSP response line, the given headers plus CSeq and
+// Content-Length, and an optional body.
+func (s *rtspServer) respond(conn net.Conn, cseq string, code int, reason string, header textproto.MIMEHeader, body []byte) {
+	fmt.Fprintf(conn, "RTSP/1.0 %d %s\r\n", code, reason)
+	if cseq != "" {
+		fmt.Fprintf(conn, "CSeq: %s\r\n", cseq)
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			fmt.Fprintf(conn, "%s: %s\r\n", k, v)
+		}
+	}
+	fmt.Fprintf(conn, "Content-Length: %d\r\n\r\n", len(body))
+	conn.Write(body)
+}
+
+// stream paces on d's ring the same way streamMJPEG does, packetizing
+// each newly completed frame and writing it to conn interleaved
+// (RFC 2326 section 10.12: '$', channel, 2-byte length, RTP packet).
+func (s *rtspServer) stream(ctx context.Context, conn net.Conn) {
+	stats.clientConnected()
+	defer stats.clientDisconnected()
+
+	s.d.mu.RLock()
+	pixelformat := s.d.pixelformat
+	s.d.mu.RUnlock()
+
+	rtp := newRTPStream(rtpPayloadType(pixelformat))
+	start := time.Now()
+
+	var lastSeq uint64
+	var frames *ring
+	for {
+		s.d.mu.RLock()
+		curFrames := s.d.frames
+		s.d.mu.RUnlock()
+
+		if curFrames != frames {
+			frames = curFrames
+			lastSeq = 0
+		}
+
+		frame, seq, err := frames.wait(ctx, lastSeq)
+		if err != nil {
+			return
+		}
+		if lastSeq != 0 && seq > lastSeq+1 {
+			stats.recordDropped(seq - lastSeq - 1)
+		}
+		lastSeq = seq
+
+		timestamp := uint32(time.Since(start).Seconds() * rtpClockRate)
+
+		var packets [][]byte
+		if isH264(pixelformat) {
+			packets = rtp.packetizeH264(frame, timestamp)
+		} else {
+			var packetizeErr error
+			packets, packetizeErr = rtp.packetizeJPEG(frame, timestamp)
+			if packetizeErr != nil {
+				log.Println("rtsp: packetize:", packetizeErr)
+				continue
+			}
+		}
+
+		for _, pkt := range packets {
+			if err := writeInterleaved(conn, rtspChannelRTP, pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeInterleaved wraps an RTP packet in the '$' framing RFC 2326
+// section 10.12 requires when RTP shares the RTSP TCP connection.
+func writeInterleaved(conn net.Conn, channel uint8, packet []byte) error {
+	frame := make([]byte, 4+len(packet))
+	frame[0] = '$'
+	frame[1] = channel
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(packet)))
+	copy(frame[4:], packet)
+	_, err := conn.Write(frame)
+	return err
+}
+
+// isH264 reports whether pixelformat is the H.264 FourCC.
+func isH264(pixelformat uint32) bool {
+	return pixelformat == fourCCCode("H264")
+}
+
+// rtpPayloadType picks the RTP static (JPEG) or dynamic (H.264) payload
+// type number for pixelformat.
+func rtpPayloadType(pixelformat uint32) uint8 {
+	if isH264(pixelformat) {
+		return payloadTypeH264
+	}
+	return payloadTypeJPEG
+}
@@ -0,0 +1,27 @@
+package v4l2
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Poll waits up to timeout for fd to become readable. It returns
+// ErrTimeout if no frame arrives in time, so callers have a bounded
+// wait to check for shutdown rather than blocking forever in select().
+func Poll(fd int, timeout time.Duration) error {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return &RequestError{Request: "poll", Err: err}
+		}
+		if n == 0 {
+			return ErrTimeout
+		}
+		return nil
+	}
+}
@@ -0,0 +1,286 @@
+// Package v4l2 wraps the Video4Linux2 ioctl calls used by frameserver:
+// every ioctl retries on EINTR, maps common failures to typed sentinel
+// errors, and reports the originating request name so callers and logs
+// don't just see a bare errno.
+package v4l2
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Buffer type, memory type, and field constants used by this package.
+const (
+	BufTypeVideoCapture = 1
+	MemoryMMAP          = 1
+	FieldNone           = 1
+
+	FrmSizeTypeDiscrete   = 1
+	FrmSizeTypeStepwise   = 2
+	FrmSizeTypeContinuous = 3
+
+	FrmIvalTypeDiscrete   = 1
+	FrmIvalTypeStepwise   = 2
+	FrmIvalTypeContinuous = 3
+)
+
+const (
+	ioctlSFmt              = 0xc0cc5605
+	ioctlReqBufs           = 0xc0145608
+	ioctlQueryBuf          = 0xc0445609
+	ioctlStreamOn          = 0x40045612
+	ioctlStreamOff         = 0x40045613
+	ioctlQBuf              = 0xc044560f
+	ioctlDQBuf             = 0xc0445611
+	ioctlQueryCap          = 0x80685600
+	ioctlEnumFmt           = 0xc0405602
+	ioctlEnumFrameSizes    = 0xc02c564a
+	ioctlEnumFrameInterval = 0xc034564b
+	ioctlSParm             = 0xc0cc5616
+)
+
+// Sentinel errors a RequestError may wrap. Compare against these with
+// errors.Is rather than switching on a raw syscall.Errno.
+var (
+	ErrBusy     = errors.New("v4l2: device busy")
+	ErrNoBuffer = errors.New("v4l2: no buffer available")
+	ErrTimeout  = errors.New("v4l2: timed out waiting for frame")
+)
+
+// RequestError reports which ioctl request failed and why.
+type RequestError struct {
+	Request string
+	Err     error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("v4l2: %s: %v", e.Request, e.Err)
+}
+
+func (e *RequestError) Unwrap() error { return e.Err }
+
+// ioctl invokes the given request, retrying on EINTR (a signal arrived
+// mid-call) since the request itself was never actually attempted.
+// EAGAIN and EBUSY are mapped to ErrNoBuffer and ErrBusy respectively;
+// any other errno is wrapped as-is.
+func ioctl(fd int, name string, req uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+		switch errno {
+		case 0:
+			return nil
+		case unix.EINTR:
+			continue
+		case unix.EAGAIN:
+			return &RequestError{Request: name, Err: ErrNoBuffer}
+		case unix.EBUSY:
+			return &RequestError{Request: name, Err: ErrBusy}
+		default:
+			return &RequestError{Request: name, Err: errno}
+		}
+	}
+}
+
+type Capability struct {
+	Driver       [16]uint8
+	Card         [32]uint8
+	BusInfo      [32]uint8
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	reserved     [3]uint32
+}
+
+type PixFormat struct {
+	Type         uint32
+	Width        uint32
+	Height       uint32
+	PixelFormat  uint32
+	Field        uint32
+	BytesPerLine uint32
+	SizeImage    uint32
+	Colorspace   uint32
+	priv         uint32
+}
+
+type requestBuffers struct {
+	Count    uint32
+	Type     uint32
+	Memory   uint32
+	reserved [2]uint32
+}
+
+type timecode struct {
+	typ      uint32
+	flags    uint32
+	frames   uint8
+	seconds  uint8
+	minutes  uint8
+	hours    uint8
+	userbits [4]uint8
+}
+
+type timeval struct {
+	sec  uint32
+	usec uint32
+}
+
+type Buffer struct {
+	Index     uint32
+	Type      uint32
+	BytesUsed uint32
+	Flags     uint32
+	Field     uint32
+	timestamp timeval
+	timecode  timecode
+	Sequence  uint32
+	Memory    uint32
+	Offset    uint32
+	Length    uint32
+	reserved2 uint32
+	reserved  uint32
+}
+
+type FmtDesc struct {
+	Index       uint32
+	Type        uint32
+	Flags       uint32
+	Description [32]uint8
+	PixelFormat uint32
+	mbusCode    uint32
+	reserved    [3]uint32
+}
+
+// FrmSizeEnum mirrors the kernel's discriminated union of discrete or
+// stepwise frame sizes as a flat byte array; decode Union based on Type.
+type FrmSizeEnum struct {
+	Index       uint32
+	PixelFormat uint32
+	Type        uint32
+	Union       [24]byte
+	reserved    [2]uint32
+}
+
+// FrmIvalEnum mirrors the kernel's discriminated union of discrete or
+// stepwise frame intervals; decode Union based on Type.
+type FrmIvalEnum struct {
+	Index       uint32
+	PixelFormat uint32
+	Width       uint32
+	Height      uint32
+	Type        uint32
+	Union       [24]byte
+	reserved    [2]uint32
+}
+
+type fract struct {
+	numerator   uint32
+	denominator uint32
+}
+
+type captureParm struct {
+	capability   uint32
+	captureMode  uint32
+	timePerFrame fract
+	extendedMode uint32
+	readBuffers  uint32
+	reserved     [4]uint32
+}
+
+type streamParm struct {
+	typ     uint32
+	capture captureParm
+	_       [160]byte
+}
+
+// QueryCap issues VIDIOC_QUERYCAP.
+func QueryCap(fd int) (Capability, error) {
+	var c Capability
+	err := ioctl(fd, "VIDIOC_QUERYCAP", ioctlQueryCap, unsafe.Pointer(&c))
+	return c, err
+}
+
+// SetFormat issues VIDIOC_S_FMT.
+func SetFormat(fd int, pf *PixFormat) error {
+	return ioctl(fd, "VIDIOC_S_FMT", ioctlSFmt, unsafe.Pointer(pf))
+}
+
+// RequestBuffers issues VIDIOC_REQBUFS for count MMAP capture buffers
+// and returns the number the driver actually allocated.
+func RequestBuffers(fd int, count uint32) (uint32, error) {
+	req := requestBuffers{Count: count, Type: BufTypeVideoCapture, Memory: MemoryMMAP}
+	if err := ioctl(fd, "VIDIOC_REQBUFS", ioctlReqBufs, unsafe.Pointer(&req)); err != nil {
+		return 0, err
+	}
+	return req.Count, nil
+}
+
+// QueryBuf issues VIDIOC_QUERYBUF for the given buffer index.
+func QueryBuf(fd int, index uint32) (Buffer, error) {
+	buf := Buffer{Type: BufTypeVideoCapture, Memory: MemoryMMAP, Index: index}
+	err := ioctl(fd, "VIDIOC_QUERYBUF", ioctlQueryBuf, unsafe.Pointer(&buf))
+	return buf, err
+}
+
+// QBuf issues VIDIOC_QBUF, enqueueing buf for capture.
+func QBuf(fd int, buf *Buffer) error {
+	return ioctl(fd, "VIDIOC_QBUF", ioctlQBuf, unsafe.Pointer(buf))
+}
+
+// DQBuf issues VIDIOC_DQBUF, dequeueing the next completed buffer.
+func DQBuf(fd int) (Buffer, error) {
+	buf := Buffer{Type: BufTypeVideoCapture, Memory: MemoryMMAP}
+	err := ioctl(fd, "VIDIOC_DQBUF", ioctlDQBuf, unsafe.Pointer(&buf))
+	return buf, err
+}
+
+// StreamOn issues VIDIOC_STREAMON.
+func StreamOn(fd int) error {
+	typ := uint32(BufTypeVideoCapture)
+	return ioctl(fd, "VIDIOC_STREAMON", ioctlStreamOn, unsafe.Pointer(&typ))
+}
+
+// StreamOff issues VIDIOC_STREAMOFF.
+func StreamOff(fd int) error {
+	typ := uint32(BufTypeVideoCapture)
+	return ioctl(fd, "VIDIOC_STREAMOFF", ioctlStreamOff, unsafe.Pointer(&typ))
+}
+
+// EnumFmt issues VIDIOC_ENUM_FMT for the given format index.
+func EnumFmt(fd int, index uint32) (FmtDesc, error) {
+	fdesc := FmtDesc{Type: BufTypeVideoCapture, Index: index}
+	err := ioctl(fd, "VIDIOC_ENUM_FMT", ioctlEnumFmt, unsafe.Pointer(&fdesc))
+	return fdesc, err
+}
+
+// EnumFrameSizes issues VIDIOC_ENUM_FRAMESIZES for the given pixel
+// format and size index.
+func EnumFrameSizes(fd int, pixelformat, index uint32) (FrmSizeEnum, error) {
+	fsize := FrmSizeEnum{Index: index, PixelFormat: pixelformat}
+	err := ioctl(fd, "VIDIOC_ENUM_FRAMESIZES", ioctlEnumFrameSizes, unsafe.Pointer(&fsize))
+	return fsize, err
+}
+
+// EnumFrameIntervals issues VIDIOC_ENUM_FRAMEINTERVALS for the given
+// pixel format, frame size, and interval index.
+func EnumFrameIntervals(fd int, pixelformat, width, height, index uint32) (FrmIvalEnum, error) {
+	fival := FrmIvalEnum{Index: index, PixelFormat: pixelformat, Width: width, Height: height}
+	err := ioctl(fd, "VIDIOC_ENUM_FRAMEINTERVALS", ioctlEnumFrameInterval, unsafe.Pointer(&fival))
+	return fival, err
+}
+
+// SetFrameInterval issues VIDIOC_S_PARM requesting fps frames per
+// second. Not all drivers honor this.
+func SetFrameInterval(fd int, fps uint32) error {
+	parm := streamParm{
+		typ: BufTypeVideoCapture,
+		capture: captureParm{
+			timePerFrame: fract{numerator: 1, denominator: fps},
+		},
+	}
+	return ioctl(fd, "VIDIOC_S_PARM", ioctlSParm, unsafe.Pointer(&parm))
+}
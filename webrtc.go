@@ -0,0 +1,140 @@
+// WebRTC signaling and media delivery, for viewers that want sub-100ms
+// glass-to-glass latency instead of the ~1s of polling /image.jpg.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// webrtcHandler accepts an SDP offer as a JSON body, establishes a
+// PeerConnection with one outbound video track fed from d's ring, and
+// replies with the SDP answer. -out webrtc only supports H.264 sources;
+// browsers have no built-in RTP/JPEG depacketizer, unlike the RTSP path.
+func webrtcHandler(d *device) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		d.mu.RLock()
+		pixelformat := d.pixelformat
+		d.mu.RUnlock()
+
+		if !isH264(pixelformat) {
+			http.Error(w, "-out webrtc requires an H264 source format", http.StatusPreconditionFailed)
+			return
+		}
+
+		var offer webrtc.SessionDescription
+		if err := json.NewDecoder(req.Body).Decode(&offer); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		track, err := webrtc.NewTrackLocalStaticSample(
+			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+			"video", "frameserver",
+		)
+		if err != nil {
+			pc.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := pc.AddTrack(track); err != nil {
+			pc.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// streamToTrack must outlive ServeHTTP, which returns once the SDP
+		// answer is written; req.Context() is canceled at that point, so
+		// tie its lifetime to the PeerConnection instead.
+		streamCtx, stopStream := context.WithCancel(context.Background())
+		pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			switch state {
+			case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateDisconnected:
+				stopStream()
+				pc.Close()
+			}
+		})
+
+		if err := pc.SetRemoteDescription(offer); err != nil {
+			pc.Close()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			pc.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		gatherComplete := webrtc.GatheringCompletePromise(pc)
+		if err := pc.SetLocalDescription(answer); err != nil {
+			pc.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		<-gatherComplete
+
+		go streamToTrack(streamCtx, d, track)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pc.LocalDescription())
+	})
+}
+
+// streamToTrack pushes each newly completed H.264 frame from d's ring to
+// track as a media.Sample, pacing itself on the ring the same way the
+// MJPEG and RTSP handlers do, until ctx is cancelled (the PeerConnection
+// fails, disconnects, or closes).
+func streamToTrack(ctx context.Context, d *device, track *webrtc.TrackLocalStaticSample) {
+	stats.clientConnected()
+	defer stats.clientDisconnected()
+
+	var lastSeq uint64
+	var frames *ring
+	var lastFrame time.Time
+	for {
+		d.mu.RLock()
+		curFrames := d.frames
+		d.mu.RUnlock()
+
+		if curFrames != frames {
+			frames = curFrames
+			lastSeq = 0
+		}
+
+		frame, seq, err := frames.wait(ctx, lastSeq)
+		if err != nil {
+			return
+		}
+		if lastSeq != 0 && seq > lastSeq+1 {
+			stats.recordDropped(seq - lastSeq - 1)
+		}
+		lastSeq = seq
+
+		now := time.Now()
+		duration := 33 * time.Millisecond
+		if !lastFrame.IsZero() {
+			duration = now.Sub(lastFrame)
+		}
+		lastFrame = now
+
+		sample := media.Sample{Data: frame, Duration: duration}
+		if err := track.WriteSample(sample); err != nil {
+			log.Println("webrtc: write sample:", err)
+			return
+		}
+	}
+}